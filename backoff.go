@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+const (
+	retryBaseDelay = 1 * time.Second
+	retryMaxDelay  = 30 * time.Second
+)
+
+// backoffWithJitter returns an exponentially growing delay (capped at
+// retryMaxDelay) with jitter, used to back off reconnect attempts against
+// the API server so a flapping pod/watch doesn't hammer it.
+func backoffWithJitter(attempt int) time.Duration {
+	delay := retryBaseDelay * time.Duration(1<<uint(attempt))
+	if delay > retryMaxDelay || delay <= 0 {
+		delay = retryMaxDelay
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay) / 2))
+	return delay/2 + jitter
+}
+
+// sleepBackoff waits out backoffWithJitter(attempt), returning false early
+// (without the caller retrying) if ctx is canceled first.
+func sleepBackoff(ctx context.Context, attempt int) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(backoffWithJitter(attempt)):
+		return true
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Collector is where kpersist writes everything it captures for a run:
+// resource diffs, pod logs, and pod events. Swapping the Collector built in
+// main is the only thing needed to change where a run's output lands
+// (flat directory, per-namespace directories, a single tar.gz, an
+// object-store bucket, ...) without touching any of the watch/diff/log
+// code that calls it.
+type Collector interface {
+	// OpenResource opens the destination for a tracked resource's initial
+	// content and subsequent diffs.
+	OpenResource(gvr schema.GroupVersionResource, namespace, name, ext string) io.WriteCloser
+	// OpenPodLog opens the destination for one container's log stream.
+	// Implementations that persist a pod's containers to a single combined
+	// file (kpersist's original behavior) hand back the same underlying
+	// writer, reference-counted, for every container of the same pod.
+	OpenPodLog(pod *corev1.Pod, container string) io.WriteCloser
+	// OpenPodEvents opens the destination for a pod's captured Events.
+	OpenPodEvents(pod *corev1.Pod, ext string) io.WriteCloser
+	// Close finalizes the collector once a run is done, e.g. closing off a
+	// tar.gz archive. Sinks with nothing to finalize return nil.
+	Close() error
+}
+
+// NewCollector builds the Collector described by cfg, rooted at basePath
+// (the per-run directory main already creates under BasePath). "s3"/"gcs"
+// aren't among cfg.Type's options yet: s3Collector has no credential or
+// client wiring to drive from a config file, so an object-store run means
+// calling NewS3Collector directly from a small Go entrypoint rather than
+// setting sink.type in kpersist.yaml.
+func NewCollector(cfg SinkConfig, basePath string) (Collector, error) {
+	switch cfg.Type {
+	case "", "flat":
+		return NewFlatCollector(basePath), nil
+	case "nested":
+		return NewNestedCollector(basePath), nil
+	case "targz":
+		archivePath := cfg.ArchivePath
+		if archivePath == "" {
+			archivePath = basePath + ".tar.gz"
+		}
+		return NewTarGzCollector(archivePath)
+	case "s3", "gcs":
+		return nil, fmt.Errorf("sink type %q isn't configurable via kpersist.yaml yet; construct an s3Collector with NewS3Collector from a Go entrypoint instead", cfg.Type)
+	default:
+		return nil, fmt.Errorf("unknown sink type %q", cfg.Type)
+	}
+}
+
+func stampNow() string {
+	return time.Now().Format("20060102_150405.00000")
+}
+
+func resourceFileName(gvr schema.GroupVersionResource, name, ext string) string {
+	return fmt.Sprintf("%s_%s_%s.%s", stampNow(), gvr.Resource, name, ext)
+}
+
+func podLogFileName(pod *corev1.Pod) string {
+	return fmt.Sprintf("%s_pod_%s.txt", stampNow(), pod.Name)
+}
+
+func podEventsFileName(pod *corev1.Pod, ext string) string {
+	return fmt.Sprintf("%s_pod_%s_events.%s", stampNow(), pod.Name, ext)
+}
+
+// namespaceDir is the directory/prefix segment a namespaced sink files a
+// resource or pod under; cluster-scoped resources have no namespace.
+func namespaceDir(namespace string) string {
+	if namespace == "" {
+		return "cluster"
+	}
+	return namespace
+}
+
+// refCountedWriteCloser lets several callers share one underlying
+// WriteCloser (e.g. one combined pod log file written by several container
+// goroutines) without one caller's Close ending the others' writes; the
+// underlying writer only closes once every acquired reference has closed.
+type refCountedWriteCloser struct {
+	mu      sync.Mutex
+	w       io.WriteCloser
+	count   int
+	onClose func()
+}
+
+func (r *refCountedWriteCloser) acquire() io.WriteCloser {
+	r.mu.Lock()
+	r.count++
+	r.mu.Unlock()
+	return r
+}
+
+func (r *refCountedWriteCloser) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.w.Write(p)
+}
+
+func (r *refCountedWriteCloser) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.count--
+	if r.count > 0 {
+		return nil
+	}
+	if r.onClose != nil {
+		r.onClose()
+	}
+	return r.w.Close()
+}
+
+// fileCollector is the shared machinery behind the flat-directory and
+// nested-per-namespace-directory Collectors: both just create an *os.File
+// at a different path.
+type fileCollector struct {
+	resourcePath  func(gvr schema.GroupVersionResource, namespace, name, ext string) string
+	podLogPath    func(pod *corev1.Pod) string
+	podEventsPath func(pod *corev1.Pod, ext string) string
+
+	mu      sync.Mutex
+	podLogs map[types.UID]*refCountedWriteCloser
+}
+
+// NewFlatCollector persists everything under a single directory, matching
+// kpersist's original layout.
+func NewFlatCollector(basePath string) Collector {
+	return &fileCollector{
+		resourcePath: func(gvr schema.GroupVersionResource, namespace, name, ext string) string {
+			return filepath.Join(basePath, resourceFileName(gvr, name, ext))
+		},
+		podLogPath: func(pod *corev1.Pod) string {
+			return filepath.Join(basePath, podLogFileName(pod))
+		},
+		podEventsPath: func(pod *corev1.Pod, ext string) string {
+			return filepath.Join(basePath, podEventsFileName(pod, ext))
+		},
+	}
+}
+
+// NewNestedCollector persists everything under basePath, split into one
+// subdirectory per namespace (cluster-scoped resources land under
+// "cluster"), so a run against many namespaces doesn't dump everything
+// into one flat listing.
+func NewNestedCollector(basePath string) Collector {
+	return &fileCollector{
+		resourcePath: func(gvr schema.GroupVersionResource, namespace, name, ext string) string {
+			return filepath.Join(basePath, namespaceDir(namespace), resourceFileName(gvr, name, ext))
+		},
+		podLogPath: func(pod *corev1.Pod) string {
+			return filepath.Join(basePath, namespaceDir(pod.Namespace), podLogFileName(pod))
+		},
+		podEventsPath: func(pod *corev1.Pod, ext string) string {
+			return filepath.Join(basePath, namespaceDir(pod.Namespace), podEventsFileName(pod, ext))
+		},
+	}
+}
+
+func (fc *fileCollector) OpenResource(gvr schema.GroupVersionResource, namespace, name, ext string) io.WriteCloser {
+	return createFile(fc.resourcePath(gvr, namespace, name, ext))
+}
+
+func (fc *fileCollector) OpenPodLog(pod *corev1.Pod, _ string) io.WriteCloser {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	if fc.podLogs == nil {
+		fc.podLogs = map[types.UID]*refCountedWriteCloser{}
+	}
+	if rc, ok := fc.podLogs[pod.UID]; ok {
+		return rc.acquire()
+	}
+
+	uid := pod.UID
+	rc := &refCountedWriteCloser{w: createFile(fc.podLogPath(pod))}
+	rc.onClose = func() {
+		fc.mu.Lock()
+		delete(fc.podLogs, uid)
+		fc.mu.Unlock()
+	}
+	fc.podLogs[uid] = rc
+	return rc.acquire()
+}
+
+func (fc *fileCollector) OpenPodEvents(pod *corev1.Pod, ext string) io.WriteCloser {
+	return createFile(fc.podEventsPath(pod, ext))
+}
+
+func (fc *fileCollector) Close() error { return nil }
+
+func createFile(path string) *os.File {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		panic(err)
+	}
+
+	out, err := os.Create(path)
+	if err != nil {
+		fmt.Printf("Error while creating file %s: %s\n", path, err.Error())
+		panic(err)
+	}
+
+	fmt.Printf("Writing to file %s\n", path)
+	return out
+}
+
+// targzCollector writes every opened destination as one entry in a single
+// streaming tar.gz archive, so a run downloads as one file (handy in CI).
+// A tar entry's header needs its final size up front, so every writer this
+// Collector hands out buffers in memory and only appends its entry once
+// Close is called.
+type targzCollector struct {
+	file *os.File
+	gzw  *gzip.Writer
+
+	mu sync.Mutex
+	tw *tar.Writer
+}
+
+// NewTarGzCollector opens archivePath and prepares a tar.gz stream to it.
+func NewTarGzCollector(archivePath string) (Collector, error) {
+	if err := os.MkdirAll(filepath.Dir(archivePath), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Create(archivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	gzw := gzip.NewWriter(file)
+	fmt.Printf("Writing archive %s\n", archivePath)
+	return &targzCollector{file: file, gzw: gzw, tw: tar.NewWriter(gzw)}, nil
+}
+
+func (c *targzCollector) OpenResource(gvr schema.GroupVersionResource, namespace, name, ext string) io.WriteCloser {
+	return c.entry(filepath.Join(namespaceDir(namespace), resourceFileName(gvr, name, ext)))
+}
+
+func (c *targzCollector) OpenPodLog(pod *corev1.Pod, container string) io.WriteCloser {
+	name := podLogFileName(pod)
+	if container != "" {
+		name = strings.TrimSuffix(name, ".txt") + "_" + container + ".txt"
+	}
+	return c.entry(filepath.Join(namespaceDir(pod.Namespace), name))
+}
+
+func (c *targzCollector) OpenPodEvents(pod *corev1.Pod, ext string) io.WriteCloser {
+	return c.entry(filepath.Join(namespaceDir(pod.Namespace), podEventsFileName(pod, ext)))
+}
+
+func (c *targzCollector) entry(name string) io.WriteCloser {
+	return &bufferedTarEntry{name: name, archive: c}
+}
+
+func (c *targzCollector) writeEntry(name string, content []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.tw.WriteHeader(&tar.Header{
+		Name: name,
+		Mode: 0644,
+		Size: int64(len(content)),
+	}); err != nil {
+		return err
+	}
+	_, err := c.tw.Write(content)
+	return err
+}
+
+func (c *targzCollector) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.tw.Close(); err != nil {
+		return err
+	}
+	if err := c.gzw.Close(); err != nil {
+		return err
+	}
+	return c.file.Close()
+}
+
+// bufferedTarEntry accumulates one destination's content in memory and
+// appends it as a single tar entry to its archive when closed.
+type bufferedTarEntry struct {
+	name    string
+	buf     bytes.Buffer
+	archive *targzCollector
+}
+
+func (e *bufferedTarEntry) Write(p []byte) (int, error) {
+	return e.buf.Write(p)
+}
+
+func (e *bufferedTarEntry) Close() error {
+	return e.archive.writeEntry(e.name, e.buf.Bytes())
+}
+
+// s3PartSize is S3's minimum multipart upload part size (except for the
+// final part of an upload).
+const s3PartSize = 5 * 1024 * 1024
+
+// ObjectStoreAPI is the minimal multipart-upload surface s3Collector needs
+// from an S3-compatible object store (AWS S3, a GCS interoperability
+// endpoint, MinIO, ...). kpersist deliberately doesn't depend on any
+// particular SDK; wire a concrete implementation (e.g. a thin adapter over
+// aws-sdk-go-v2's s3.Client) when constructing an s3Collector.
+type ObjectStoreAPI interface {
+	CreateMultipartUpload(ctx context.Context, bucket, key string) (uploadID string, err error)
+	UploadPart(ctx context.Context, bucket, key, uploadID string, partNumber int32, body []byte) (etag string, err error)
+	CompleteMultipartUpload(ctx context.Context, bucket, key, uploadID string, etags []string) error
+	AbortMultipartUpload(ctx context.Context, bucket, key, uploadID string) error
+}
+
+// s3Collector persists every destination as its own object under prefix in
+// bucket, uploaded via multipart upload so a long-lived log stream doesn't
+// have to fit in memory before it can start uploading. It's built with
+// NewS3Collector from a Go entrypoint, not via SinkConfig/NewCollector: an
+// ObjectStoreAPI client and its credentials aren't the kind of thing a
+// kpersist.yaml can describe.
+type s3Collector struct {
+	ctx    context.Context
+	api    ObjectStoreAPI
+	bucket string
+	prefix string
+}
+
+// NewS3Collector builds a Collector that uploads through api, the caller's
+// chosen S3-compatible client.
+func NewS3Collector(ctx context.Context, api ObjectStoreAPI, bucket, prefix string) Collector {
+	return &s3Collector{ctx: ctx, api: api, bucket: bucket, prefix: prefix}
+}
+
+func (c *s3Collector) key(name string) string {
+	return filepath.Join(c.prefix, name)
+}
+
+func (c *s3Collector) OpenResource(gvr schema.GroupVersionResource, namespace, name, ext string) io.WriteCloser {
+	return newMultipartUpload(c.ctx, c.api, c.bucket, c.key(filepath.Join(namespaceDir(namespace), resourceFileName(gvr, name, ext))))
+}
+
+func (c *s3Collector) OpenPodLog(pod *corev1.Pod, container string) io.WriteCloser {
+	name := podLogFileName(pod)
+	if container != "" {
+		name = strings.TrimSuffix(name, ".txt") + "_" + container + ".txt"
+	}
+	return newMultipartUpload(c.ctx, c.api, c.bucket, c.key(filepath.Join(namespaceDir(pod.Namespace), name)))
+}
+
+func (c *s3Collector) OpenPodEvents(pod *corev1.Pod, ext string) io.WriteCloser {
+	return newMultipartUpload(c.ctx, c.api, c.bucket, c.key(filepath.Join(namespaceDir(pod.Namespace), podEventsFileName(pod, ext))))
+}
+
+func (c *s3Collector) Close() error { return nil }
+
+// multipartUpload buffers writes and uploads a part as soon as s3PartSize
+// bytes have accumulated, so a long-running stream uploads incrementally
+// instead of buffering the whole object. Close completes the upload, or
+// aborts it if a part upload ever failed.
+type multipartUpload struct {
+	ctx    context.Context
+	api    ObjectStoreAPI
+	bucket string
+	key    string
+
+	uploadID string
+	buf      bytes.Buffer
+	etags    []string
+	err      error
+}
+
+func newMultipartUpload(ctx context.Context, api ObjectStoreAPI, bucket, key string) *multipartUpload {
+	return &multipartUpload{ctx: ctx, api: api, bucket: bucket, key: key}
+}
+
+func (u *multipartUpload) Write(p []byte) (int, error) {
+	if u.err != nil {
+		return 0, u.err
+	}
+
+	n, _ := u.buf.Write(p)
+	for u.buf.Len() >= s3PartSize {
+		if err := u.flushPart(u.buf.Next(s3PartSize)); err != nil {
+			u.err = err
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (u *multipartUpload) flushPart(part []byte) error {
+	if u.uploadID == "" {
+		uploadID, err := u.api.CreateMultipartUpload(u.ctx, u.bucket, u.key)
+		if err != nil {
+			return err
+		}
+		u.uploadID = uploadID
+	}
+
+	etag, err := u.api.UploadPart(u.ctx, u.bucket, u.key, u.uploadID, int32(len(u.etags)+1), part)
+	if err != nil {
+		return err
+	}
+	u.etags = append(u.etags, etag)
+	return nil
+}
+
+func (u *multipartUpload) Close() error {
+	if u.err != nil {
+		if u.uploadID != "" {
+			_ = u.api.AbortMultipartUpload(u.ctx, u.bucket, u.key, u.uploadID)
+		}
+		return u.err
+	}
+
+	if u.buf.Len() > 0 || u.uploadID == "" {
+		remaining := u.buf.Bytes()
+		if err := u.flushPart(remaining); err != nil {
+			_ = u.api.AbortMultipartUpload(u.ctx, u.bucket, u.key, u.uploadID)
+			return err
+		}
+		u.buf.Reset()
+	}
+
+	return u.api.CompleteMultipartUpload(u.ctx, u.bucket, u.key, u.uploadID, u.etags)
+}
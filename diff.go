@@ -0,0 +1,424 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nsf/jsondiff"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// DiffFormat selects how processResourceModifications renders each captured
+// change to a tracked resource's output file.
+type DiffFormat string
+
+const (
+	DiffFormatText      DiffFormat = "text"
+	DiffFormatJSONPatch DiffFormat = "jsonpatch"
+	DiffFormatUnified   DiffFormat = "unified"
+	DiffFormatJSONL     DiffFormat = "jsonl"
+)
+
+// fileExt returns the file extension conventionally used for format's
+// output, so e.g. the JSONL event log gets a .jsonl file instead of .txt.
+func (format DiffFormat) fileExt() string {
+	if format == DiffFormatJSONL {
+		return "jsonl"
+	}
+	return "txt"
+}
+
+// DiffFormatter renders the difference between two revisions of a tracked
+// resource. It returns ok=false when the change was entirely filtered out
+// as noise, in which case the caller writes nothing.
+type DiffFormatter interface {
+	Format(prev, curr *unstructured.Unstructured) (output string, ok bool, err error)
+}
+
+// NewDiffFormatter builds the formatter for format, applying filter to every
+// diff it renders.
+func NewDiffFormatter(format DiffFormat, filter *PathFilter) (DiffFormatter, error) {
+	switch format {
+	case "", DiffFormatText:
+		return &textDiffFormatter{filter: filter}, nil
+	case DiffFormatJSONPatch:
+		return &jsonPatchDiffFormatter{filter: filter}, nil
+	case DiffFormatUnified:
+		return &unifiedDiffFormatter{filter: filter}, nil
+	case DiffFormatJSONL:
+		return &jsonlDiffFormatter{filter: filter}, nil
+	default:
+		return nil, fmt.Errorf("unknown diff format %q", format)
+	}
+}
+
+// PathFilter decides which JSON-pointer paths in a resource diff count as
+// meaningful, so reconciles that only touch noisy bookkeeping fields like
+// /metadata/resourceVersion don't drown out real changes like a
+// .status.phase transition.
+type PathFilter struct {
+	Allow []string
+	Deny  []string
+}
+
+// defaultDenyPaths matches fields every controller reconcile churns on its
+// own, with no signal about what a user actually changed.
+var defaultDenyPaths = []string{
+	"/metadata/resourceVersion",
+	"/metadata/managedFields",
+	"/status/observedGeneration",
+}
+
+// isNoisy reports whether path should be suppressed: it matches a Deny
+// pattern, or Allow is non-empty and path matches none of its patterns.
+func (f *PathFilter) isNoisy(path string) bool {
+	if f == nil {
+		return false
+	}
+
+	for _, pattern := range f.Deny {
+		if matchesGlobPath(path, pattern) {
+			return true
+		}
+	}
+
+	if len(f.Allow) == 0 {
+		return false
+	}
+	for _, pattern := range f.Allow {
+		if matchesGlobPath(path, pattern) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesGlobPath(path, pattern string) bool {
+	ok, err := filepath.Match(pattern, path)
+	return err == nil && ok
+}
+
+// filterOps drops every op in ops whose path filter.isNoisy.
+func filterOps(ops []patchOp, filter *PathFilter) []patchOp {
+	meaningful := ops[:0:0]
+	for _, op := range ops {
+		if !filter.isNoisy(op.Path) {
+			meaningful = append(meaningful, op)
+		}
+	}
+	return meaningful
+}
+
+// empty reports whether f has no Allow/Deny patterns configured, i.e.
+// wouldn't change anything it filtered.
+func (f *PathFilter) empty() bool {
+	return f == nil || (len(f.Allow) == 0 && len(f.Deny) == 0)
+}
+
+// isDenied reports whether path itself matches one of filter's Deny
+// patterns. Unlike isNoisy, it says nothing about Allow: a container node
+// can't be ruled noisy just because its own path isn't Allow-listed, since
+// one of its descendants still might be.
+func (f *PathFilter) isDenied(path string) bool {
+	if f == nil {
+		return false
+	}
+	for _, pattern := range f.Deny {
+		if matchesGlobPath(path, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactForDiff returns a deep copy of obj with every field filterOps would
+// drop removed, so formatters that render from the documents themselves
+// (rather than from filterOps' output) still hide the same churn, e.g.
+// /metadata/resourceVersion. Doing nothing when filter has no patterns
+// configured avoids deep-copying every tracked resource on every update.
+func redactForDiff(obj map[string]any, filter *PathFilter) map[string]any {
+	if filter.empty() {
+		return obj
+	}
+	redacted, _ := redactNoisyPaths("", obj, filter)
+	return redacted.(map[string]any)
+}
+
+// redactNoisyPaths returns the value at path with denied nodes pruned at
+// whatever depth they occur (so e.g. the /metadata/managedFields object is
+// dropped outright) and, for leaf values, prunes ones filter.isNoisy rules
+// out entirely, including via an Allow list. isNoisy isn't applied to
+// intermediate map nodes: a path matching no Allow pattern doesn't mean none
+// of its descendants do.
+func redactNoisyPaths(path string, value any, filter *PathFilter) (any, bool) {
+	if filter.isDenied(path) {
+		return nil, false
+	}
+
+	m, ok := value.(map[string]any)
+	if !ok {
+		return value, !filter.isNoisy(path)
+	}
+
+	redacted := make(map[string]any, len(m))
+	for key, v := range m {
+		childPath := path + "/" + escapeJSONPointer(key)
+		if rv, keep := redactNoisyPaths(childPath, v, filter); keep {
+			redacted[key] = rv
+		}
+	}
+	return redacted, true
+}
+
+// patchOp is one RFC 6902 JSON Patch operation.
+type patchOp struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value any    `json:"value,omitempty"`
+}
+
+// diffOps computes the RFC 6902 JSON Patch that turns prev into curr.
+// Changed map fields are walked recursively so each op's path points at the
+// most specific field that changed; a changed array is replaced wholesale
+// rather than diffed element-by-element.
+func diffOps(prev, curr map[string]any) []patchOp {
+	var ops []patchOp
+	collectDiffOps("", prev, curr, &ops)
+	sort.Slice(ops, func(i, j int) bool { return ops[i].Path < ops[j].Path })
+	return ops
+}
+
+func collectDiffOps(path string, prev, curr any, ops *[]patchOp) {
+	prevMap, prevIsMap := prev.(map[string]any)
+	currMap, currIsMap := curr.(map[string]any)
+	if prevIsMap && currIsMap {
+		keys := map[string]bool{}
+		for k := range prevMap {
+			keys[k] = true
+		}
+		for k := range currMap {
+			keys[k] = true
+		}
+		sortedKeys := make([]string, 0, len(keys))
+		for k := range keys {
+			sortedKeys = append(sortedKeys, k)
+		}
+		sort.Strings(sortedKeys)
+
+		for _, key := range sortedKeys {
+			childPath := path + "/" + escapeJSONPointer(key)
+			pv, inPrev := prevMap[key]
+			cv, inCurr := currMap[key]
+			switch {
+			case !inPrev:
+				*ops = append(*ops, patchOp{Op: "add", Path: childPath, Value: cv})
+			case !inCurr:
+				*ops = append(*ops, patchOp{Op: "remove", Path: childPath})
+			default:
+				collectDiffOps(childPath, pv, cv, ops)
+			}
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(prev, curr) {
+		*ops = append(*ops, patchOp{Op: "replace", Path: path, Value: curr})
+	}
+}
+
+func escapeJSONPointer(key string) string {
+	key = strings.ReplaceAll(key, "~", "~0")
+	key = strings.ReplaceAll(key, "/", "~1")
+	return key
+}
+
+func renderDiffHeader(body string) string {
+	return fmt.Sprintf("\n----------------------------------\nChange captured at %s:\n%s\n----------------------------------\n", time.Now().Format(time.RFC3339Nano), body)
+}
+
+// textDiffFormatter is kpersist's original format: jsondiff's textual,
+// color-coded rendering of the two full JSON documents.
+type textDiffFormatter struct {
+	filter *PathFilter
+}
+
+func (f *textDiffFormatter) Format(prev, curr *unstructured.Unstructured) (string, bool, error) {
+	if len(filterOps(diffOps(prev.Object, curr.Object), f.filter)) == 0 {
+		return "", false, nil
+	}
+
+	prevJSON, err := json.Marshal(redactForDiff(prev.Object, f.filter))
+	if err != nil {
+		return "", false, err
+	}
+	currJSON, err := json.Marshal(redactForDiff(curr.Object, f.filter))
+	if err != nil {
+		return "", false, err
+	}
+
+	options := jsondiff.DefaultJSONOptions()
+	options.SkipMatches = true
+	_, diffs := jsondiff.Compare(prevJSON, currJSON, &options)
+
+	return renderDiffHeader(diffs), true, nil
+}
+
+// jsonPatchDiffFormatter renders each change as an RFC 6902 JSON Patch
+// document, for consumers that want to apply or machine-parse the diff
+// rather than read it.
+type jsonPatchDiffFormatter struct {
+	filter *PathFilter
+}
+
+func (f *jsonPatchDiffFormatter) Format(prev, curr *unstructured.Unstructured) (string, bool, error) {
+	ops := filterOps(diffOps(prev.Object, curr.Object), f.filter)
+	if len(ops) == 0 {
+		return "", false, nil
+	}
+
+	raw, err := json.MarshalIndent(ops, "", "\t")
+	if err != nil {
+		return "", false, err
+	}
+
+	return renderDiffHeader(string(raw)), true, nil
+}
+
+// unifiedDiffFormatter renders a grep-friendly unified diff between
+// pretty-printed JSON revisions, for reviewers who want to eyeball a change
+// without a jq/json-patch tool handy.
+type unifiedDiffFormatter struct {
+	filter *PathFilter
+}
+
+func (f *unifiedDiffFormatter) Format(prev, curr *unstructured.Unstructured) (string, bool, error) {
+	if len(filterOps(diffOps(prev.Object, curr.Object), f.filter)) == 0 {
+		return "", false, nil
+	}
+
+	prevRaw, err := json.MarshalIndent(redactForDiff(prev.Object, f.filter), "", "\t")
+	if err != nil {
+		return "", false, err
+	}
+	currRaw, err := json.MarshalIndent(redactForDiff(curr.Object, f.filter), "", "\t")
+	if err != nil {
+		return "", false, err
+	}
+
+	diff := unifiedDiffLines(strings.Split(string(prevRaw), "\n"), strings.Split(string(currRaw), "\n"))
+	return renderDiffHeader(diff), true, nil
+}
+
+// unifiedDiffLines renders a minimal unified diff (every line, no hunk
+// headers or context trimming) between a and b, aligned on their longest
+// common subsequence.
+func unifiedDiffLines(a, b []string) string {
+	lcs := longestCommonSubsequence(a, b)
+
+	var out strings.Builder
+	i, j, k := 0, 0, 0
+	for i < len(a) || j < len(b) {
+		if k < len(lcs) && i < len(a) && j < len(b) && a[i] == lcs[k] && b[j] == lcs[k] {
+			out.WriteString(" " + a[i] + "\n")
+			i++
+			j++
+			k++
+			continue
+		}
+		if i < len(a) && (k >= len(lcs) || a[i] != lcs[k]) {
+			out.WriteString("-" + a[i] + "\n")
+			i++
+			continue
+		}
+		if j < len(b) {
+			out.WriteString("+" + b[j] + "\n")
+			j++
+		}
+	}
+	return out.String()
+}
+
+// longestCommonSubsequence returns the LCS of a and b via the standard
+// O(n*m) dynamic-programming table, used to align unchanged lines in
+// unifiedDiffLines.
+func longestCommonSubsequence(a, b []string) []string {
+	n, m := len(a), len(b)
+	dp := make([][]int, n+1)
+	for i := range dp {
+		dp[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				dp[i][j] = dp[i+1][j+1] + 1
+			case dp[i+1][j] >= dp[i][j+1]:
+				dp[i][j] = dp[i+1][j]
+			default:
+				dp[i][j] = dp[i][j+1]
+			}
+		}
+	}
+
+	var lcs []string
+	i, j := 0, 0
+	for i < n && j < m {
+		switch {
+		case a[i] == b[j]:
+			lcs = append(lcs, a[i])
+			i++
+			j++
+		case dp[i+1][j] >= dp[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return lcs
+}
+
+// jsonlEvent is one line of a jsonlDiffFormatter event log.
+type jsonlEvent struct {
+	Timestamp       string    `json:"ts"`
+	ResourceVersion string    `json:"resourceVersion"`
+	Generation      int64     `json:"generation"`
+	Patch           []patchOp `json:"patch"`
+	ChangedFields   []string  `json:"changedFields"`
+}
+
+// jsonlDiffFormatter renders each change as one JSON object per line, for
+// feeding a tracked resource's history into log-shipping or analytics
+// tooling that expects newline-delimited JSON.
+type jsonlDiffFormatter struct {
+	filter *PathFilter
+}
+
+func (f *jsonlDiffFormatter) Format(prev, curr *unstructured.Unstructured) (string, bool, error) {
+	ops := filterOps(diffOps(prev.Object, curr.Object), f.filter)
+	if len(ops) == 0 {
+		return "", false, nil
+	}
+
+	changedFields := make([]string, len(ops))
+	for i, op := range ops {
+		changedFields[i] = op.Path
+	}
+
+	raw, err := json.Marshal(jsonlEvent{
+		Timestamp:       time.Now().Format(time.RFC3339Nano),
+		ResourceVersion: curr.GetResourceVersion(),
+		Generation:      curr.GetGeneration(),
+		Patch:           ops,
+		ChangedFields:   changedFields,
+	})
+	if err != nil {
+		return "", false, err
+	}
+
+	return string(raw) + "\n", true, nil
+}
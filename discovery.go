@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+)
+
+// validateResources checks every configured GVR exists in the cluster via
+// the discovery client, failing fast at startup with a clear error listing
+// the resources actually available for that group/version, rather than
+// letting a typo surface as an opaque "failed to create watcher" later.
+func validateResources(disco discovery.DiscoveryInterface, resources []ResourceWatchConfig) error {
+	for _, r := range resources {
+		gv := schema.GroupVersion{Group: r.Group, Version: r.Version}.String()
+
+		list, err := disco.ServerResourcesForGroupVersion(gv)
+		if err != nil {
+			return fmt.Errorf("discovering resources for %s: %w", gv, err)
+		}
+
+		available := make([]string, 0, len(list.APIResources))
+		found := false
+		for _, apiResource := range list.APIResources {
+			available = append(available, apiResource.Name)
+			if apiResource.Name == r.Resource {
+				found = true
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("resource %q not found in %s, available resources: %s", r.Resource, gv, strings.Join(available, ", "))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+// EventFormat selects how captured pod Events are rendered to disk.
+type EventFormat string
+
+const (
+	EventFormatText EventFormat = "text"
+	EventFormatYAML EventFormat = "yaml"
+)
+
+// fileExt returns the file extension conventionally used for format's
+// output, so e.g. YAML-formatted events get a .yaml file instead of .txt.
+func (format EventFormat) fileExt() string {
+	if format == EventFormatYAML {
+		return "yaml"
+	}
+	return "txt"
+}
+
+// watchPodEvents records every Event involving the given pod to a sibling
+// file next to its log file, so failure modes like ImagePullBackOff,
+// FailedScheduling or OOMKills are captured even when they never produce
+// container log output. It shares the pod's lifecycle: it starts when the
+// pod is Added and stops once wp is marked non-retryable (pod Deleted).
+func watchPodEvents(ctx context.Context, clientset *kubernetes.Clientset, collector Collector, wp *watchedPod, format EventFormat) {
+	out := collector.OpenPodEvents(wp.pod, format.fileExt())
+	defer out.Close()
+
+	fieldSelector := fmt.Sprintf("involvedObject.uid=%s", wp.pod.UID)
+	resourceVersion := ""
+
+	for attempt := 0; wp.retryable(); {
+		var err error
+		var streamed, expired bool
+		resourceVersion, streamed, expired, err = streamPodEvents(ctx, clientset, wp.pod.Namespace, fieldSelector, resourceVersion, out, format)
+		if err == nil {
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		fmt.Printf("Error watching events for pod %s, reconnecting: %s\n", wp.pod.Name, err.Error())
+		if expired {
+			// The watch's resourceVersion fell out of the apiserver's
+			// compaction window; an empty resourceVersion starts a fresh
+			// watch from "now" instead of failing identically forever.
+			resourceVersion = ""
+		}
+		if streamed {
+			attempt = 0
+		} else {
+			attempt++
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoffWithJitter(attempt)):
+		}
+	}
+}
+
+// streamPodEvents opens a single Event watch starting from resourceVersion
+// (empty for an initial watch) and writes every event until the watch
+// closes or errors, returning the last seen resourceVersion (so the caller
+// can reconnect without missing or duplicating events), whether the session
+// streamed at least one event (so the caller can reset its backoff instead
+// of letting it creep toward the cap over a long-lived, otherwise healthy
+// pod), and whether the failure means resourceVersion itself expired (a
+// fresh watch is the only way to recover).
+func streamPodEvents(ctx context.Context, clientset *kubernetes.Clientset, namespace, fieldSelector, resourceVersion string, out io.Writer, format EventFormat) (lastResourceVersion string, streamed bool, expired bool, err error) {
+	watcher, err := clientset.CoreV1().Events(namespace).Watch(ctx, metav1.ListOptions{
+		FieldSelector:   fieldSelector,
+		ResourceVersion: resourceVersion,
+	})
+	if err != nil {
+		return resourceVersion, false, apierrors.IsResourceExpired(err) || apierrors.IsGone(err), err
+	}
+	defer watcher.Stop()
+
+	lastResourceVersion = resourceVersion
+	for event := range watcher.ResultChan() {
+		if event.Type == watch.Error {
+			watchErr := apierrors.FromObject(event.Object)
+			return lastResourceVersion, streamed, apierrors.IsResourceExpired(watchErr) || apierrors.IsGone(watchErr),
+				fmt.Errorf("event watch error: %w", watchErr)
+		}
+
+		podEvent, ok := event.Object.(*corev1.Event)
+		if !ok {
+			continue
+		}
+		streamed = true
+		lastResourceVersion = podEvent.ResourceVersion
+
+		if err := writePodEvent(out, event.Type, podEvent, format); err != nil {
+			return lastResourceVersion, streamed, false, err
+		}
+	}
+
+	return lastResourceVersion, streamed, false, fmt.Errorf("event watch channel closed")
+}
+
+func writePodEvent(out io.Writer, eventType watch.EventType, event *corev1.Event, format EventFormat) error {
+	if format == EventFormatYAML {
+		raw, err := yaml.Marshal(event)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(out, "---\n# %s\n%s", eventType, raw)
+		return err
+	}
+
+	_, err := fmt.Fprintf(out, "[%s] %s %s: %s (reason=%s, count=%d)\n",
+		event.LastTimestamp.Format(time.RFC3339Nano), eventType, event.Type, event.Message, event.Reason, event.Count)
+	return err
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ansiEscapeRegex strips terminal color/cursor escape sequences from log lines,
+// replacing the previous "pipe through sed" step.
+var ansiEscapeRegex = regexp.MustCompile("\x1B\\[[0-9;]*[A-Za-z]")
+
+// followAndPersistContainerLog opens one destination per matched container
+// (init, regular, and ephemeral, matching kubectl logs
+// --all-containers=true) via collector and streams its log into it.
+// Collectors that persist a pod's containers to a single combined file
+// (kpersist's original behavior) hand back a reference-counted shared
+// writer, so container goroutines here never need to coordinate directly
+// with each other.
+func followAndPersistContainerLog(c context.Context, clientset *kubernetes.Clientset, collector Collector, wp *watchedPod) {
+	var containers []string
+	for _, container := range wp.pod.Spec.InitContainers {
+		if matchesAnyGlob(container.Name, wp.containerGlobs) {
+			containers = append(containers, container.Name)
+		}
+	}
+	for _, container := range wp.pod.Spec.Containers {
+		if matchesAnyGlob(container.Name, wp.containerGlobs) {
+			containers = append(containers, container.Name)
+		}
+	}
+	for _, container := range wp.pod.Spec.EphemeralContainers {
+		if matchesAnyGlob(container.Name, wp.containerGlobs) {
+			containers = append(containers, container.Name)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, container := range containers {
+		wg.Add(1)
+		go func(container string) {
+			defer wg.Done()
+			out := collector.OpenPodLog(wp.pod, container)
+			defer out.Close()
+			streamContainerLog(c, clientset, wp, container, out)
+		}(container)
+	}
+	wg.Wait()
+
+	fmt.Printf("Done writing logs from pod %s\n", wp.pod.Name)
+}
+
+// streamContainerLog opens a native log stream for a single container and
+// keeps re-opening it while the pod is retryable, backing off with jitter
+// between attempts so a flapping container doesn't hammer the API server.
+func streamContainerLog(c context.Context, clientset *kubernetes.Clientset, wp *watchedPod, container string, writer io.Writer) {
+	for attempt := 0; ; attempt++ {
+		if !wp.retryable() {
+			return
+		}
+
+		req := clientset.CoreV1().Pods(wp.pod.Namespace).GetLogs(wp.pod.Name, &corev1.PodLogOptions{
+			Container:  container,
+			Follow:     true,
+			Timestamps: true,
+		})
+
+		err := streamOnce(c, req.Stream, container, writer)
+		if err == nil {
+			return
+		}
+
+		if c.Err() != nil || !isRecoverableLogError(err) {
+			fmt.Printf("Terminal error streaming logs for pod %s container %s: %s\n", wp.pod.Name, container, err.Error())
+			wp.stop()
+			return
+		}
+
+		fmt.Printf("Recoverable error streaming logs for pod %s container %s, retrying: %s\n", wp.pod.Name, container, err.Error())
+		select {
+		case <-c.Done():
+			return
+		case <-time.After(backoffWithJitter(attempt)):
+		}
+	}
+}
+
+func streamOnce(c context.Context, open func(context.Context) (io.ReadCloser, error), container string, writer io.Writer) error {
+	stream, err := open(c)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	scanner := bufio.NewScanner(stream)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := ansiEscapeRegex.ReplaceAllString(scanner.Text(), "")
+		if _, err := fmt.Fprintf(writer, "[%s] %s\n", container, line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// isRecoverableLogError decides whether a failure opening/reading a log
+// stream is worth retrying (container not started yet, transient apiserver
+// hiccup) versus terminal (pod gone, request canceled).
+func isRecoverableLogError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if apierrors.IsNotFound(err) || apierrors.IsForbidden(err) || apierrors.IsBadRequest(err) {
+		return false
+	}
+	if apierrors.IsServerTimeout(err) || apierrors.IsTimeout(err) || apierrors.IsTooManyRequests(err) || apierrors.IsInternalError(err) || apierrors.IsServiceUnavailable(err) {
+		return true
+	}
+
+	msg := err.Error()
+	for _, marker := range []string{"ContainerCreating", "PodInitializing", "is waiting to start", "has not been started"} {
+		if strings.Contains(msg, marker) {
+			return true
+		}
+	}
+
+	// EOF and similar mean the stream just ended (e.g. container restarted);
+	// worth another attempt as long as the pod is still around.
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -4,20 +4,22 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"github.com/nsf/jsondiff"
+	"io"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 	"log/slog"
 	"os"
-	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"sync"
@@ -28,13 +30,24 @@ import (
 // TODO logs, structure, tests, error handling, etc
 
 const (
-	BasePath  = "./kpersist-logs"
-	K8sEnvVar = "KUBECONFIG"
+	BasePath          = "./kpersist-logs"
+	K8sEnvVar         = "KUBECONFIG"
+	DefaultConfigPath = "kpersist.yaml"
 )
 
 func main() {
+	eventFormat := flag.String("event-format", string(EventFormatText), "format for captured pod events: text or yaml")
+	configPath := flag.String("config", DefaultConfigPath, "path to kpersist config file declaring watch targets")
+	flag.Parse()
+
 	c, _ := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 
+	cfg, err := LoadConfigOrDefault(*configPath)
+	if err != nil {
+		slog.ErrorContext(c, "Error loading config", "error", err, "path", *configPath)
+		os.Exit(1)
+	}
+
 	// TODO allow other ways to point to k8s config
 	kubeconfig := os.Getenv(K8sEnvVar)
 
@@ -50,11 +63,23 @@ func main() {
 		os.Exit(1)
 	}
 
-	//forConfig, err := discovery.NewDiscoveryClientForConfig(config)
-	//if err != nil {
-	//	return
-	//}
-	//forConfig.
+	disco, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		slog.ErrorContext(c, "Error creating k8s discovery client for config", "error", err, "config", config)
+		os.Exit(1)
+	}
+
+	if err := validateResources(disco, cfg.Resources); err != nil {
+		slog.ErrorContext(c, "Error validating configured watch targets against the cluster", "error", err)
+		os.Exit(1)
+	}
+
+	diffFormat := DiffFormat(cfg.Diff.Format)
+	diffFormatter, err := NewDiffFormatter(diffFormat, cfg.Diff.filter())
+	if err != nil {
+		slog.ErrorContext(c, "Error configuring resource diff formatter", "error", err, "format", cfg.Diff.Format)
+		os.Exit(1)
+	}
 
 	dclient, err := dynamic.NewForConfig(config)
 	if err != nil {
@@ -63,80 +88,238 @@ func main() {
 	}
 
 	path := filepath.Join(BasePath, time.Now().Format("20060102_150405.00000"))
-	slog.InfoContext(c, "Creating directory for storing files", "path", path)
 
-	err = os.MkdirAll(path, os.ModePerm)
+	collector, err := NewCollector(cfg.Sink, path)
 	if err != nil {
-		slog.ErrorContext(c, "Error creating directory for storing files", "error", err, "path", path)
+		slog.ErrorContext(c, "Error configuring output collector", "error", err, "sink", cfg.Sink.Type)
 		os.Exit(1)
 	}
+	defer collector.Close()
+
+	// wg tracks every top-level watcher goroutine, which in turn wait out
+	// their own per-resource/per-pod persister goroutines before returning
+	// (see watchResources and watchPodsForLogs). Waiting on wg here before
+	// collector.Close runs ensures every writer it handed out is actually
+	// closed first, so e.g. a targz sink's archive isn't finalized out from
+	// under entries still being written.
+	var wg sync.WaitGroup
 
 	slog.InfoContext(c, "Initializing resource watchers")
-	go watchResources(c, path, dclient)
+	for _, target := range cfg.Resources {
+		wg.Add(1)
+		go func(target ResourceWatchConfig) {
+			defer wg.Done()
+			watchResources(c, collector, dclient, target, diffFormat, diffFormatter)
+		}(target)
+	}
 
 	slog.InfoContext(c, "Initializing logs persisters")
-	go watchPodsForLogs(c, path, clientset)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		watchPodsForLogs(c, collector, clientset, cfg.Pods, EventFormat(*eventFormat))
+	}()
 
 	<-c.Done()
+	slog.InfoContext(c, "Shutting down, draining in-flight watchers")
+	wg.Wait()
 }
 
-func watchResources(c context.Context, path string, dclient *dynamic.DynamicClient) {
+// watchResources runs a Reflector-style List+Watch loop for target: it
+// seeds known state with an initial List (remembering its resourceVersion),
+// opens a bookmark-enabled Watch from there, and on watch.Error or a closed
+// channel (410 Gone, network blip, apiserver restart) reconnects with
+// exponential backoff instead of dying silently. A Watch that's expired
+// (the bookmarked resourceVersion has fallen out of the apiserver's
+// compaction window) forces a fresh List; otherwise the Watch simply
+// resumes from the last resourceVersion it saw, bookmark or not, so a
+// reconnect doesn't pay for a List it doesn't need. Already tracked
+// resources are diffed against each List by name so reconnecting never
+// duplicates a file or clobbers the diff history of one still open.
+// attempt only grows across reconnects that never managed to stream
+// anything; a session that did stream resets it, so backoff doesn't creep
+// toward its cap over the life of an otherwise healthy long-running watch.
+func watchResources(c context.Context, collector Collector, dclient *dynamic.DynamicClient, target ResourceWatchConfig, diffFormat DiffFormat, formatter DiffFormatter) {
 	resource := schema.GroupVersionResource{
-		Group:    "camel.apache.org",
-		Version:  "v1",
-		Resource: "integrations",
+		Group:    target.Group,
+		Version:  target.Version,
+		Resource: target.Resource,
+	}
+	ri := dclient.Resource(resource).Namespace(target.Namespace)
+
+	channels := map[string]chan *unstructured.Unstructured{}
+
+	// trackers collects every processResourceModifications goroutine this
+	// target has spawned; waiting on it here means a shutdown (ctx
+	// canceled) doesn't return until each one has flushed and closed its
+	// destination, however it wound up here.
+	var trackers sync.WaitGroup
+	defer trackers.Wait()
+
+	resourceVersion := ""
+	attempt := 0
+	for {
+		if c.Err() != nil {
+			return
+		}
+
+		if resourceVersion == "" {
+			rv, err := relistResources(c, collector, ri, target, channels, diffFormat, formatter, &trackers)
+			if err != nil {
+				slog.ErrorContext(c, "Failed to list resource, retrying", "error", err, "resource", resource)
+				if !sleepBackoff(c, attempt) {
+					return
+				}
+				attempt++
+				continue
+			}
+			resourceVersion = rv
+			attempt = 0
+		}
+
+		lastRV, streamed, expired, err := watchResourcesFrom(c, collector, ri, target, resourceVersion, channels, diffFormat, formatter, &trackers)
+		if c.Err() != nil {
+			return
+		}
+		slog.ErrorContext(c, "Resource watch ended, reconnecting", "error", err, "resource", resource)
+
+		if expired {
+			resourceVersion = ""
+		} else {
+			resourceVersion = lastRV
+		}
+		if streamed {
+			attempt = 0
+		} else {
+			attempt++
+		}
+		if !sleepBackoff(c, attempt) {
+			return
+		}
 	}
+}
 
-	watcher, err := dclient.
-		Resource(resource).
-		Watch(c, metav1.ListOptions{})
+// relistResources lists the current state of target, starting tracking for
+// any resource not already in channels and stopping tracking for any
+// previously known resource that's gone missing. It returns the list's
+// resourceVersion, used to seed the following Watch.
+func relistResources(c context.Context, collector Collector, ri dynamic.ResourceInterface, target ResourceWatchConfig, channels map[string]chan *unstructured.Unstructured, diffFormat DiffFormat, formatter DiffFormatter, trackers *sync.WaitGroup) (string, error) {
+	list, err := ri.List(c, metav1.ListOptions{LabelSelector: target.LabelSelector, FieldSelector: target.FieldSelector})
 	if err != nil {
-		slog.ErrorContext(c, "Failed to create watcher for resource", "error", err, "resource", resource)
+		return "", err
 	}
 
-	channels := map[string]chan *unstructured.Unstructured{}
+	seen := map[string]bool{}
+	for i := range list.Items {
+		typedObj := &list.Items[i]
+		name := typedObj.GetName()
+		seen[name] = true
+		if _, ok := channels[name]; !ok {
+			startTrackingResource(c, collector, target, typedObj, channels, diffFormat, formatter, trackers)
+		}
+	}
 
+	for name, ch := range channels {
+		if !seen[name] {
+			close(ch)
+			delete(channels, name)
+		}
+	}
+
+	return list.GetResourceVersion(), nil
+}
+
+// watchResourcesFrom opens a single bookmark-enabled Watch starting at
+// resourceVersion and applies Added/Modified/Deleted/Bookmark events until
+// the watch closes or errors. It returns the resourceVersion of the last
+// event it saw (so the caller can resume the Watch without relisting),
+// whether the session streamed at least one event, whether the failure
+// means resourceVersion itself expired (a relist is the only way to
+// recover), and why the watch ended.
+func watchResourcesFrom(c context.Context, collector Collector, ri dynamic.ResourceInterface, target ResourceWatchConfig, resourceVersion string, channels map[string]chan *unstructured.Unstructured, diffFormat DiffFormat, formatter DiffFormatter, trackers *sync.WaitGroup) (lastResourceVersion string, streamed bool, expired bool, err error) {
+	watcher, err := ri.Watch(c, metav1.ListOptions{
+		LabelSelector:       target.LabelSelector,
+		FieldSelector:       target.FieldSelector,
+		ResourceVersion:     resourceVersion,
+		AllowWatchBookmarks: true,
+	})
+	if err != nil {
+		return resourceVersion, false, apierrors.IsResourceExpired(err) || apierrors.IsGone(err), err
+	}
+	defer watcher.Stop()
+
+	lastResourceVersion = resourceVersion
 	for event := range watcher.ResultChan() {
+		streamed = true
 		switch event.Type {
 		case watch.Added:
-			fmt.Printf("Watch Integration Event: %s\n", event.Type)
-
+			fmt.Printf("Watch %s Event: %s\n", target.Resource, event.Type)
 			typedObj := event.Object.(*unstructured.Unstructured)
-
-			name := typedObj.GetName()
-			ch := make(chan *unstructured.Unstructured, 10)
-
-			time := time.Now().Format("20060102_150405.00000")
-			fileName := filepath.Join(path, fmt.Sprintf("%s_integration_%s.txt", time, name))
-			fmt.Printf("Writing to file %s\n", fileName)
-
-			file := writeInitialFileContent(fileName, typedObj)
-
-			channels[name] = ch
-			go processResourceModifications(file, ch, typedObj)
+			startTrackingResource(c, collector, target, typedObj, channels, diffFormat, formatter, trackers)
+			lastResourceVersion = typedObj.GetResourceVersion()
 		case watch.Modified:
-			fmt.Printf("Watch Integration Event: %s\n", event.Type)
+			fmt.Printf("Watch %s Event: %s\n", target.Resource, event.Type)
 			typedObj := event.Object.(*unstructured.Unstructured)
 			name := typedObj.GetName()
-			channels[name] <- typedObj
+			if ch, ok := channels[name]; ok {
+				select {
+				case ch <- typedObj:
+				case <-c.Done():
+					return lastResourceVersion, streamed, false, c.Err()
+				}
+			}
+			lastResourceVersion = typedObj.GetResourceVersion()
 		case watch.Deleted:
 			typedObj := event.Object.(*unstructured.Unstructured)
 			name := typedObj.GetName()
-			close(channels[name])
-			delete(channels, name)
+			if ch, ok := channels[name]; ok {
+				close(ch)
+				delete(channels, name)
+			}
+			lastResourceVersion = typedObj.GetResourceVersion()
+		case watch.Bookmark:
+			// A bookmark carries no content of its own, just an up-to-date
+			// resourceVersion to resume from on reconnect without relisting.
+			typedObj := event.Object.(*unstructured.Unstructured)
+			lastResourceVersion = typedObj.GetResourceVersion()
+		case watch.Error:
+			watchErr := apierrors.FromObject(event.Object)
+			return lastResourceVersion, streamed, apierrors.IsResourceExpired(watchErr) || apierrors.IsGone(watchErr),
+				fmt.Errorf("watch error for resource %s: %w", target.Resource, watchErr)
 		default:
-			fmt.Printf("Unsupported Integration Event: %s\n", event.Type)
+			fmt.Printf("Unsupported %s Event: %s\n", target.Resource, event.Type)
 		}
 	}
+
+	return lastResourceVersion, streamed, false, fmt.Errorf("watch channel closed for resource %s", target.Resource)
 }
 
-func writeInitialFileContent(fileName string, typedObj *unstructured.Unstructured) *os.File {
-	out, err := os.Create(fileName)
-	if err != nil {
-		fmt.Printf("Error while creating file %s: %s\n", fileName, err.Error())
-		panic(err)
+// startTrackingResource begins diffing typedObj's future modifications to a
+// new destination opened via collector, skipping resources already tracked
+// under channels. trackers is incremented for the tracking goroutine it
+// spawns, so the caller can wait for it to flush and close its destination
+// on shutdown.
+func startTrackingResource(ctx context.Context, collector Collector, target ResourceWatchConfig, typedObj *unstructured.Unstructured, channels map[string]chan *unstructured.Unstructured, diffFormat DiffFormat, formatter DiffFormatter, trackers *sync.WaitGroup) {
+	name := typedObj.GetName()
+	if _, ok := channels[name]; ok {
+		return
 	}
 
+	ch := make(chan *unstructured.Unstructured, 10)
+
+	gvr := schema.GroupVersionResource{Group: target.Group, Version: target.Version, Resource: target.Resource}
+	out := collector.OpenResource(gvr, target.Namespace, name, diffFormat.fileExt())
+	writeInitialFileContent(out, typedObj)
+
+	channels[name] = ch
+	trackers.Add(1)
+	go func() {
+		defer trackers.Done()
+		processResourceModifications(ctx, out, ch, typedObj, formatter)
+	}()
+}
+
+func writeInitialFileContent(out io.WriteCloser, typedObj *unstructured.Unstructured) {
 	typedObj.SetManagedFields(nil)
 	jsonBytes, err := typedObj.MarshalJSON()
 	if err != nil {
@@ -149,203 +332,250 @@ func writeInitialFileContent(fileName string, typedObj *unstructured.Unstructure
 		panic(err)
 	}
 
-	_, err = out.Write(prettyJson.Bytes())
-	if err != nil {
-		fmt.Printf("Error while writing resource to %s: %s\n", fileName, err.Error())
-		_, err := out.WriteString(fmt.Sprintf("kpersist: error occurred while writing this log file: %s", err.Error()))
-		if err != nil {
-			panic(err)
-		}
+	if _, err := out.Write(prettyJson.Bytes()); err != nil {
 		panic(err)
 	}
-
-	return out
 }
 
-func processResourceModifications(out *os.File, ch chan *unstructured.Unstructured, obj *unstructured.Unstructured) {
+// processResourceModifications applies every modification sent on ch to out
+// until ch closes (the resource was deleted or went missing from a List) or
+// ctx is canceled (kpersist is shutting down), closing out either way so a
+// collector that finalizes on Close (e.g. a tar.gz archive) sees this
+// destination's content.
+func processResourceModifications(ctx context.Context, out io.WriteCloser, ch chan *unstructured.Unstructured, obj *unstructured.Unstructured, formatter DiffFormatter) {
 	prev := obj
 	prev.SetManagedFields(nil)
 
 	defer out.Close()
 
-	for curr := range ch {
-		prevJson, err := prev.MarshalJSON()
-		if err != nil {
-			panic(err)
-		}
-
-		curr.SetManagedFields(nil)
-
-		currJson, err := curr.MarshalJSON()
-		if err != nil {
-			panic(err)
-		}
-
-		options := jsondiff.DefaultJSONOptions()
-		options.SkipMatches = true
-		_, diffs := jsondiff.Compare(prevJson, currJson, &options)
+	for {
+		select {
+		case curr, ok := <-ch:
+			if !ok {
+				return
+			}
+			curr.SetManagedFields(nil)
 
-		_, err = out.WriteString(fmt.Sprintf("\n----------------------------------\nChange captured at %s:\n", time.Now().Format(time.RFC3339Nano)))
-		if err != nil {
-			panic(err)
-		}
-		_, err = out.WriteString(fmt.Sprintf("%s\n----------------------------------\n", diffs))
-		if err != nil {
-			fmt.Printf("Error while writing resource to %s: %s\n", out.Name(), err.Error())
-			_, err := out.WriteString(fmt.Sprintf("kpersist: error occurred while writing this log file: %s", err.Error()))
+			output, ok, err := formatter.Format(prev, curr)
 			if err != nil {
 				panic(err)
 			}
-			panic(err)
-		}
 
-		err = out.Sync()
-		if err != nil {
-			panic(err)
-		}
+			if ok {
+				if _, err := io.WriteString(out, output); err != nil {
+					panic(err)
+				}
+			}
 
-		prev = curr
+			prev = curr
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
 type watchedPod struct {
-	cond     *sync.Cond
-	pod      *corev1.Pod
-	canRetry bool
+	mu             sync.Mutex
+	pod            *corev1.Pod
+	canRetry       bool
+	containerGlobs []string
+	cancel         context.CancelFunc
 }
 
-func watchPodsForLogs(ctx context.Context, basePath string, clientset *kubernetes.Clientset) {
-	// TODO allow setting selectors
-	watcher, err := clientset.CoreV1().Pods("").Watch(ctx, metav1.ListOptions{LabelSelector: "camel.apache.org/integration"})
-	if err != nil {
-		panic(err)
+// retryable reports whether the pod is still known to be alive, i.e.
+// whether a container log stream is worth reopening after a failure.
+func (wp *watchedPod) retryable() bool {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	return wp.canRetry
+}
+
+// stop marks the pod as no longer retryable, e.g. after a terminal log
+// error or once the pod has been deleted from the cluster, and cancels the
+// context its log/events goroutines were given. Canceling is what actually
+// unblocks a goroutine parked in a long-lived watch (e.g. watchPodEvents'
+// Events-by-UID watch, which doesn't close on its own just because the pod
+// was deleted); retryable alone only gets checked between attempts.
+func (wp *watchedPod) stop() {
+	wp.mu.Lock()
+	wp.canRetry = false
+	cancel := wp.cancel
+	wp.mu.Unlock()
+	if cancel != nil {
+		cancel()
 	}
+}
 
+// watchPodsForLogs runs the same Reflector-style List+Watch loop as
+// watchResources, but for pods: it seeds known pods with an initial List,
+// opens a bookmark-enabled Watch from there, and reconnects with backoff
+// whenever the watch closes or errors. A Watch only falls back to a fresh
+// List when its resourceVersion has expired; otherwise it resumes from the
+// last resourceVersion it saw, bookmark or not. attempt resets whenever a
+// session manages to stream something, so backoff doesn't creep toward its
+// cap over the life of an otherwise healthy long-running watch. Pods
+// already being followed are diffed by UID against each List so a
+// reconnect never starts a second log/events goroutine for the same pod.
+func watchPodsForLogs(ctx context.Context, collector Collector, clientset *kubernetes.Clientset, podsCfg PodWatchConfig, eventFormat EventFormat) {
 	pods := map[types.UID]*watchedPod{}
 
-	for event := range watcher.ResultChan() {
-		fmt.Printf("Watch Pod Event: %s\n", event.Type)
-		if event.Type == watch.Added {
-			pod := event.Object.(*corev1.Pod)
+	// trackers collects every per-pod log/events goroutine spawned along the
+	// way; waiting on it here means a shutdown (ctx canceled) doesn't return
+	// until each one has flushed and closed its destinations.
+	var trackers sync.WaitGroup
+	defer trackers.Wait()
+
+	resourceVersion := ""
+	attempt := 0
+	for {
+		if ctx.Err() != nil {
+			return
+		}
 
-			wp := watchedPod{
-				pod:      pod,
-				cond:     sync.NewCond(&sync.Mutex{}),
-				canRetry: true,
+		if resourceVersion == "" {
+			rv, err := relistPods(ctx, collector, clientset, podsCfg, eventFormat, pods, &trackers)
+			if err != nil {
+				slog.ErrorContext(ctx, "Failed to list pods, retrying", "error", err)
+				if !sleepBackoff(ctx, attempt) {
+					return
+				}
+				attempt++
+				continue
 			}
+			resourceVersion = rv
+			attempt = 0
+		}
 
-			pods[pod.UID] = &wp
+		lastRV, streamed, expired, err := watchPodsFrom(ctx, collector, clientset, podsCfg, eventFormat, resourceVersion, pods, &trackers)
+		if ctx.Err() != nil {
+			return
+		}
+		slog.ErrorContext(ctx, "Pod watch ended, reconnecting", "error", err)
 
-			go followAndPersistContainerLog(ctx, basePath, wp)
+		if expired {
+			resourceVersion = ""
+		} else {
+			resourceVersion = lastRV
 		}
-		if event.Type == watch.Modified {
-			pod := event.Object.(*corev1.Pod)
-			wp := pods[pod.UID]
-			if wp != nil {
-				wp.cond.Signal()
-			} else {
-				fmt.Printf("Pod modified that wasn't previously known: %s/%s", pod.Name, pod.UID)
-			}
+		if streamed {
+			attempt = 0
+		} else {
+			attempt++
 		}
-		if event.Type == watch.Deleted {
-			pod := event.Object.(*corev1.Pod)
-			wp := pods[pod.UID]
-			if wp != nil {
-				wp.cond.L.Lock()
-				wp.canRetry = false
-				wp.cond.L.Unlock()
-				wp.cond.Signal()
-				delete(pods, pod.UID)
-			} else {
-				fmt.Printf("Pod deleted that wasn't previously known: %s/%s", pod.Name, pod.UID)
-			}
+		if !sleepBackoff(ctx, attempt) {
+			return
 		}
 	}
 }
 
-func followAndPersistContainerLog(c context.Context, basePath string, wp watchedPod) {
-
-	time := time.Now().Format("20060102_150405.00000")
-	fileName := filepath.Join(basePath, fmt.Sprintf("%s_pod_%s.txt", time, wp.pod.Name))
-	fmt.Printf("Writing to file %s\n", fileName)
-
-	out, err := os.Create(fileName)
+// relistPods lists the pods currently matching podsCfg, starting tracking
+// for any pod not already in pods and stopping tracking for any previously
+// known pod that's gone missing. It returns the list's resourceVersion,
+// used to seed the following Watch.
+func relistPods(ctx context.Context, collector Collector, clientset *kubernetes.Clientset, podsCfg PodWatchConfig, eventFormat EventFormat, pods map[types.UID]*watchedPod, trackers *sync.WaitGroup) (string, error) {
+	list, err := clientset.CoreV1().Pods("").List(ctx, metav1.ListOptions{
+		LabelSelector: podsCfg.LabelSelector,
+		FieldSelector: podsCfg.FieldSelector,
+	})
 	if err != nil {
-		fmt.Printf("Error while creating file %s: %s\n", fileName, err.Error())
-		panic(err)
+		return "", err
 	}
-	defer out.Close()
-	defer out.Sync()
 
-	wp.cond.L.Lock()
-	defer wp.cond.L.Unlock()
-	for cont := true; cont; cont = wp.canRetry {
-		execKubectl(c, wp, out)
-		wp.cond.Wait()
+	seen := map[types.UID]bool{}
+	for i := range list.Items {
+		pod := &list.Items[i]
+		seen[pod.UID] = true
+		startTrackingPod(ctx, collector, clientset, podsCfg, eventFormat, pod, pods, trackers)
 	}
 
-	s := fmt.Sprintf("Done writing logs from pod %s", wp.pod.Name)
-	fmt.Println(s)
-	out.WriteString(s)
-}
-
-func execKubectl(c context.Context, wp watchedPod, out *os.File) {
-	kubectl := exec.CommandContext(
-		c,
-		"kubectl",
-		"logs",
-		wp.pod.Name,
-		"-n="+wp.pod.Namespace,
-		"--follow=true",
-		"--all-containers=true",
-		"--ignore-errors=true",
-		"--pod-running-timeout=5m",
-		"--prefix=true",
-		"--timestamps=true",
-	)
-
-	// sed to remove colors
-	sed := exec.CommandContext(
-		c,
-		"sed",
-		"s/\\x1B\\[[0-9;]\\{1,\\}[A-Za-z]//g",
-	)
-
-	// pipe kubectl output to sed input
-	var err error
-	sed.Stdin, err = kubectl.StdoutPipe()
-	if err != nil {
-		fmt.Printf("Error getting logs: %s\n", err.Error())
-		panic(err)
+	for uid, wp := range pods {
+		if !seen[uid] {
+			wp.stop()
+			delete(pods, uid)
+		}
 	}
 
-	// write sed and all errors to file (out)
-	kubectl.Stderr = out
-	sed.Stdout = out
-	sed.Stderr = out
+	return list.ResourceVersion, nil
+}
 
-	err = sed.Start()
+// watchPodsFrom opens a single bookmark-enabled Watch starting at
+// resourceVersion and applies Added/Deleted/Bookmark events until the watch
+// closes or errors. It returns the resourceVersion of the last event it saw
+// (so the caller can resume the Watch without relisting), whether the
+// session streamed at least one event, whether the failure means
+// resourceVersion itself expired (a relist is the only way to recover), and
+// why the watch ended.
+func watchPodsFrom(ctx context.Context, collector Collector, clientset *kubernetes.Clientset, podsCfg PodWatchConfig, eventFormat EventFormat, resourceVersion string, pods map[types.UID]*watchedPod, trackers *sync.WaitGroup) (lastResourceVersion string, streamed bool, expired bool, err error) {
+	watcher, err := clientset.CoreV1().Pods("").Watch(ctx, metav1.ListOptions{
+		LabelSelector:       podsCfg.LabelSelector,
+		FieldSelector:       podsCfg.FieldSelector,
+		ResourceVersion:     resourceVersion,
+		AllowWatchBookmarks: true,
+	})
 	if err != nil {
-		s := fmt.Sprintf("Error when trying to get logs from pod %s: %+v", wp.pod.Name, err)
-		fmt.Println(s)
-		out.WriteString(s)
-		return
+		return resourceVersion, false, apierrors.IsResourceExpired(err) || apierrors.IsGone(err), err
 	}
+	defer watcher.Stop()
 
-	defer func() {
-		err = sed.Wait()
-		if err != nil {
-			s := fmt.Sprintf("Error when trying to get logs from pod %s: %+v", wp.pod.Name, err)
-			fmt.Println(s)
-			out.WriteString(s)
+	lastResourceVersion = resourceVersion
+	for event := range watcher.ResultChan() {
+		fmt.Printf("Watch Pod Event: %s\n", event.Type)
+		streamed = true
+		switch event.Type {
+		case watch.Added:
+			pod := event.Object.(*corev1.Pod)
+			startTrackingPod(ctx, collector, clientset, podsCfg, eventFormat, pod, pods, trackers)
+			lastResourceVersion = pod.ResourceVersion
+		case watch.Deleted:
+			pod := event.Object.(*corev1.Pod)
+			if wp, ok := pods[pod.UID]; ok {
+				wp.stop()
+				delete(pods, pod.UID)
+			} else {
+				fmt.Printf("Pod deleted that wasn't previously known: %s/%s", pod.Name, pod.UID)
+			}
+			lastResourceVersion = pod.ResourceVersion
+		case watch.Bookmark:
+			// A bookmark carries no content of its own, just an up-to-date
+			// resourceVersion to resume from on reconnect without relisting.
+			pod := event.Object.(*corev1.Pod)
+			lastResourceVersion = pod.ResourceVersion
+		case watch.Error:
+			watchErr := apierrors.FromObject(event.Object)
+			return lastResourceVersion, streamed, apierrors.IsResourceExpired(watchErr) || apierrors.IsGone(watchErr),
+				fmt.Errorf("watch error for pods: %w", watchErr)
 		}
-	}()
+	}
 
-	err = kubectl.Run()
-	if err != nil {
-		s := fmt.Sprintf("Error when trying to get logs from pod %s: %+v", wp.pod.Name, err)
-		fmt.Println(s)
-		out.WriteString(s)
+	return lastResourceVersion, streamed, false, fmt.Errorf("watch channel closed for pods")
+}
+
+// startTrackingPod begins following a pod's logs and events, skipping pods
+// already tracked under pods. trackers is incremented for both goroutines it
+// spawns, so the caller can wait for them to flush and close their
+// destinations on shutdown.
+func startTrackingPod(ctx context.Context, collector Collector, clientset *kubernetes.Clientset, podsCfg PodWatchConfig, eventFormat EventFormat, pod *corev1.Pod, pods map[types.UID]*watchedPod, trackers *sync.WaitGroup) {
+	if _, ok := pods[pod.UID]; ok {
 		return
 	}
+
+	eventsCtx, cancelEvents := context.WithCancel(ctx)
+	wp := &watchedPod{
+		pod:            pod,
+		canRetry:       true,
+		containerGlobs: podsCfg.ContainerGlobs,
+		cancel:         cancelEvents,
+	}
+	pods[pod.UID] = wp
+
+	trackers.Add(2)
+	go func() {
+		defer trackers.Done()
+		followAndPersistContainerLog(ctx, clientset, collector, wp)
+	}()
+	go func() {
+		defer trackers.Done()
+		defer cancelEvents()
+		watchPodEvents(eventsCtx, clientset, collector, wp, eventFormat)
+	}()
 }